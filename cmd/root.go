@@ -0,0 +1,20 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// NewRootCommand builds the config-policy-controller CLI's root command and wires in its
+// subcommands.
+func NewRootCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config-policy-controller",
+		Short: "config-policy-controller manages ConfigurationPolicy resources on a managed cluster",
+	}
+
+	cmd.AddCommand(NewTriggerUninstallCommand())
+
+	return cmd
+}
@@ -0,0 +1,108 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"open-cluster-management.io/config-policy-controller/pkg/triggeruninstall"
+)
+
+// NewTriggerUninstallCommand builds the `config-policy-controller trigger-uninstall` subcommand,
+// which lets a cluster administrator run the same cleanup the controller performs before it is
+// uninstalled, without waiting for the operator lifecycle manager to do it.
+func NewTriggerUninstallCommand() *cobra.Command {
+	var (
+		kubeconfig          string
+		deploymentName      string
+		deploymentNamespace string
+		policyNamespace     string
+		policyTimeout       time.Duration
+		overallDeadline     time.Duration
+		backoffSteps        int
+		backoffBaseDelay    time.Duration
+		dryRun              bool
+		skipPolicies        []string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "trigger-uninstall",
+		Short: "Clean up ConfigurationPolicy finalizers ahead of an uninstall",
+		Long: "Removes the delete-related-objects finalizer from every ConfigurationPolicy in the " +
+			"given namespace and annotates the config-policy-controller Deployment so the operator " +
+			"lifecycle manager knows it is safe to finish uninstalling.",
+		RunE: func(_ *cobra.Command, _ []string) error {
+			config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+			if err != nil {
+				return fmt.Errorf("failed to load the kubeconfig: %w", err)
+			}
+
+			skip := make([]types.NamespacedName, 0, len(skipPolicies))
+
+			for _, nsName := range skipPolicies {
+				parsed, err := parseNamespacedName(nsName, policyNamespace)
+				if err != nil {
+					return err
+				}
+
+				skip = append(skip, parsed)
+			}
+
+			if backoffSteps < 1 {
+				return fmt.Errorf("--backoff-steps must be at least 1, got %d", backoffSteps)
+			}
+
+			opts := triggeruninstall.DefaultOptions()
+			opts.PolicyTimeout = policyTimeout
+			opts.OverallDeadline = overallDeadline
+			opts.DryRun = dryRun
+			opts.SkipPolicies = skip
+			opts.Backoff = wait.Backoff{Duration: backoffBaseDelay, Factor: 2, Steps: backoffSteps}
+
+			return triggeruninstall.TriggerUninstall(
+				context.Background(), config, deploymentName, deploymentNamespace, policyNamespace, opts,
+			)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&kubeconfig, "kubeconfig", "", "path to the kubeconfig of the managed cluster")
+	flags.StringVar(&deploymentName, "deployment-name", "config-policy-controller", "the controller Deployment's name")
+	flags.StringVar(&deploymentNamespace, "deployment-namespace", "open-cluster-management-agent-addon",
+		"the controller Deployment's namespace")
+	flags.StringVar(&policyNamespace, "policy-namespace", "", "the namespace to clean up ConfigurationPolicies in")
+	flags.DurationVar(&policyTimeout, "policy-timeout", 0, "per-policy timeout for waiting on pruned objects (0 disables)")
+	flags.DurationVar(&overallDeadline, "deadline", 0, "overall deadline for the whole operation (0 disables)")
+	flags.IntVar(&backoffSteps, "backoff-steps", 5, "maximum number of update attempts on a resource version conflict")
+	flags.DurationVar(&backoffBaseDelay, "backoff-base-delay", 100*time.Millisecond, "base delay between conflict retries")
+	flags.BoolVar(&dryRun, "dry-run", false, "print what would be cleaned up without mutating anything")
+	flags.StringSliceVar(&skipPolicies, "skip-policy", nil,
+		"a policy to leave untouched, as 'name' or 'namespace/name'; may be repeated")
+
+	_ = cmd.MarkFlagRequired("policy-namespace")
+
+	return cmd
+}
+
+// parseNamespacedName parses a "name" or "namespace/name" flag value, defaulting to
+// defaultNamespace when only a name is given.
+func parseNamespacedName(value, defaultNamespace string) (types.NamespacedName, error) {
+	for i := len(value) - 1; i >= 0; i-- {
+		if value[i] == '/' {
+			return types.NamespacedName{Namespace: value[:i], Name: value[i+1:]}, nil
+		}
+	}
+
+	if value == "" {
+		return types.NamespacedName{}, fmt.Errorf("empty --skip-policy value")
+	}
+
+	return types.NamespacedName{Namespace: defaultNamespace, Name: value}, nil
+}
@@ -0,0 +1,22 @@
+// Copyright Contributors to the Open Cluster Management project
+
+// Package common holds constants and small helpers that are shared across the
+// config-policy-controller's reconciler, CLI, and test packages so that they don't drift
+// out of sync with one another.
+package common
+
+const (
+	// UninstallingAnnotation is set on the config-policy-controller Deployment to signal that the
+	// controller is being uninstalled and should release any cluster-scoped resources it owns
+	// (e.g. finalizers) before it is removed.
+	UninstallingAnnotation = "policy.open-cluster-management.io/uninstalling"
+
+	// PruneObjectFinalizer is placed on a ConfigurationPolicy that has `pruneObjectBehavior` set so
+	// that its related objects can be cleaned up before the policy itself is deleted.
+	PruneObjectFinalizer = "policy.open-cluster-management.io/delete-related-objects"
+
+	// TerminationProtectedConditionType is surfaced on a ConfigurationPolicy's status.conditions when
+	// `spec.terminationProtection` prevented the controller from pruning its related objects or
+	// removing its finalizer during an uninstall.
+	TerminationProtectedConditionType = "TerminationProtected"
+)
@@ -0,0 +1,83 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package triggeruninstall
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Reason is a stable, machine-readable identifier for why TriggerUninstall could not finish
+// cleaning up a ConfigurationPolicy or the Deployment's finalizer, analogous to the DepFail* reasons
+// templatesync records for dependency failures.
+type Reason string
+
+const (
+	// UninstallFailDeploymentNotFound means the config-policy-controller Deployment that
+	// TriggerUninstall was told to annotate doesn't exist.
+	UninstallFailDeploymentNotFound Reason = "DeploymentNotFound"
+
+	// UninstallFailAnnotationConflict means the Deployment could not be updated with the
+	// UninstallingAnnotation, usually because of a concurrent update to the same object.
+	UninstallFailAnnotationConflict Reason = "AnnotationConflict"
+
+	// UninstallFailFinalizerStuck means a ConfigurationPolicy's delete-related-objects finalizer
+	// could not be removed, usually because of a concurrent update to the same object.
+	UninstallFailFinalizerStuck Reason = "FinalizerStuck"
+
+	// UninstallFailPrunePending means a ConfigurationPolicy's related objects were still present
+	// when the wait for pruning gave up.
+	UninstallFailPrunePending Reason = "PrunePending"
+
+	// UninstallFailContextDeadline means a deadline TriggerUninstall itself derived from
+	// opts.PolicyTimeout or opts.OverallDeadline fired before cleanup finished. A caller-supplied
+	// ctx expiring on its own, with no Options-derived deadline involved, is reported as
+	// UninstallFailPrunePending instead, since that means the wait simply hadn't converged yet.
+	UninstallFailContextDeadline Reason = "ContextDeadline"
+)
+
+// Error wraps a Reason and the object reference it applies to, so that callers can surface
+// actionable diagnostics instead of an opaque timeout or API error.
+type Error struct {
+	Reason Reason
+	Object corev1.ObjectReference
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s: %s/%s", e.Reason, e.Object.Namespace, e.Object.Name)
+	}
+
+	return fmt.Sprintf("%s: %s/%s: %v", e.Reason, e.Object.Namespace, e.Object.Name, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newUninstallError builds an *Error for obj, copying obj's API version, kind, namespace, and name
+// into the object reference as given.
+func newUninstallError(reason Reason, obj metaObject, err error) *Error {
+	return &Error{
+		Reason: reason,
+		Object: corev1.ObjectReference{
+			APIVersion: obj.apiVersion,
+			Kind:       obj.kind,
+			Namespace:  obj.namespace,
+			Name:       obj.name,
+		},
+		Err: err,
+	}
+}
+
+// metaObject is the minimal identifying information needed to build an object reference for an
+// *Error or an Event, without requiring callers to juggle the concrete Deployment/unstructured
+// policy types.
+type metaObject struct {
+	apiVersion string
+	kind       string
+	namespace  string
+	name       string
+}
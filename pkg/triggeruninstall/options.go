@@ -0,0 +1,58 @@
+// Copyright Contributors to the Open Cluster Management project
+
+package triggeruninstall
+
+import (
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// Options configures how TriggerUninstall cleans up ConfigurationPolicies ahead of an uninstall.
+type Options struct {
+	// PolicyTimeout bounds how long TriggerUninstall will wait for a single policy's related
+	// objects to be pruned. When it expires, TriggerUninstall returns an *Error for that policy and
+	// does not process the remaining policies or annotate the Deployment. Zero means no per-policy
+	// timeout is applied beyond the overall deadline.
+	PolicyTimeout time.Duration
+
+	// OverallDeadline bounds the entire TriggerUninstall call. Zero means the context passed to
+	// TriggerUninstall is the only deadline in effect.
+	OverallDeadline time.Duration
+
+	// Backoff controls the retries TriggerUninstall performs against finalizer and annotation
+	// updates that fail because of a resource version conflict.
+	Backoff wait.Backoff
+
+	// DryRun, when true, makes TriggerUninstall only print which policies would have their
+	// finalizer removed and which related objects would be pruned, without mutating anything.
+	DryRun bool
+
+	// SkipPolicies lists policies that TriggerUninstall should leave untouched, retaining their
+	// finalizer and related objects, regardless of whether they are termination protected.
+	SkipPolicies []types.NamespacedName
+}
+
+// DefaultOptions returns the Options TriggerUninstall used before it took an explicit Options
+// argument: no per-policy or overall deadline beyond the passed context, up to five attempts on a
+// conflict, dry-run off, and nothing skipped.
+func DefaultOptions() Options {
+	return Options{
+		Backoff: wait.Backoff{
+			Duration: 100 * time.Millisecond,
+			Factor:   2,
+			Steps:    5,
+		},
+	}
+}
+
+func (o Options) skips(nsName types.NamespacedName) bool {
+	for _, skip := range o.SkipPolicies {
+		if skip == nsName {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,630 @@
+// Copyright Contributors to the Open Cluster Management project
+
+// Package triggeruninstall implements the cleanup that must happen before the
+// config-policy-controller Deployment can be safely removed from a managed cluster: every
+// ConfigurationPolicy's `delete-related-objects` finalizer is cleared so that Kubernetes is free to
+// garbage collect the policy, and the Deployment itself is annotated so the operator lifecycle
+// manager knows it is safe to proceed with the uninstall.
+//
+// This package is a one-shot, externally-driven cleanup path invoked by the trigger-uninstall CLI
+// subcommand (or an OLM pre-uninstall hook) immediately before the Deployment is torn down.
+//
+// Wait-for-prune and terminationProtection are honored only by this package. The controller's own
+// reconcile loop checks neither, so a ConfigurationPolicy deleted by any other means (e.g. a plain
+// `kubectl delete configurationpolicy` while the controller keeps running) gets neither protection.
+package triggeruninstall
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/util/retry"
+
+	"open-cluster-management.io/config-policy-controller/pkg/common"
+)
+
+// uninstallWaitAnnotation, when set to "true" on the config-policy-controller Deployment, tells
+// TriggerUninstall to block clearing a ConfigurationPolicy's finalizer until the related objects it
+// was pruning have actually been removed from the cluster, rather than clearing the finalizer as
+// soon as the deletes have been issued.
+const uninstallWaitAnnotation = "policy.open-cluster-management.io/uninstall-wait"
+
+// relatedObjectPollInterval is how often TriggerUninstall rechecks whether a policy's related
+// objects have finished deleting while in wait mode.
+const relatedObjectPollInterval = 2 * time.Second
+
+var gvrConfigPolicy = schema.GroupVersionResource{
+	Group:    "policy.open-cluster-management.io",
+	Version:  "v1",
+	Resource: "configurationpolicies",
+}
+
+// TriggerUninstall removes the delete-related-objects finalizer from every ConfigurationPolicy in
+// policyNamespace and then annotates the deploymentName Deployment in deploymentNamespace to signal
+// that the controller may be safely removed. If the Deployment carries the uninstall-wait
+// annotation, the finalizer on each policy is only removed once the objects it was pruning are
+// confirmed gone; if ctx (or a deadline derived from opts) is done first, TriggerUninstall returns
+// an *Error for that policy, leaves its finalizer in place, and processes no further policies.
+// Policies with spec.terminationProtection keep their finalizer, and if any are found the
+// Deployment is not annotated and an aggregated error naming them is returned. opts.SkipPolicies
+// are left untouched, and opts.DryRun makes TriggerUninstall print its plan instead of mutating
+// anything.
+func TriggerUninstall(
+	ctx context.Context, config *rest.Config, deploymentName, deploymentNamespace, policyNamespace string,
+	opts Options,
+) error {
+	// overallDeadlineCtx is non-nil only when opts.OverallDeadline carved a deadline out of ctx below.
+	// It lets the per-policy wait distinguish "the deadline TriggerUninstall itself imposed expired"
+	// (UninstallFailContextDeadline) from "the wait for this policy's prune didn't converge in time"
+	// (UninstallFailPrunePending), even though both ultimately surface as ctx.Err() != nil on the
+	// same ctx once OverallDeadline is in effect. callerCtx keeps the caller's own ctx so that its
+	// expiry is not mistaken for either Options-derived deadline firing.
+	callerCtx := ctx
+
+	var overallDeadlineCtx context.Context
+
+	if opts.OverallDeadline > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, opts.OverallDeadline)
+		defer cancel()
+
+		overallDeadlineCtx = ctx
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to create a Kubernetes client: %w", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to create a dynamic client: %w", err)
+	}
+
+	deploymentMeta := metaObject{
+		apiVersion: "apps/v1", kind: "Deployment", namespace: deploymentNamespace, name: deploymentName,
+	}
+
+	deployment, err := clientset.AppsV1().Deployments(deploymentNamespace).Get(
+		ctx, deploymentName, metav1.GetOptions{},
+	)
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return newUninstallError(UninstallFailDeploymentNotFound, deploymentMeta, err)
+		}
+
+		return fmt.Errorf("failed to get the %s/%s deployment: %w", deploymentNamespace, deploymentName, err)
+	}
+
+	waitForPrune := deployment.GetAnnotations()[uninstallWaitAnnotation] == "true"
+
+	policyClient := dynamicClient.Resource(gvrConfigPolicy).Namespace(policyNamespace)
+
+	policies, err := policyClient.List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list configuration policies in namespace %s: %w", policyNamespace, err)
+	}
+
+	mapper, err := newRESTMapper(clientset)
+	if err != nil {
+		return fmt.Errorf("failed to build a REST mapper: %w", err)
+	}
+
+	var protectedErrs []error
+
+	for i := range policies.Items {
+		policy := &policies.Items[i]
+
+		if !hasFinalizer(policy, common.PruneObjectFinalizer) {
+			continue
+		}
+
+		nsName := types.NamespacedName{Namespace: policy.GetNamespace(), Name: policy.GetName()}
+		if opts.skips(nsName) {
+			fmt.Printf("skipping policy %s: excluded via Options.SkipPolicies\n", nsName)
+
+			continue
+		}
+
+		if isTerminationProtected(policy) {
+			protectedErrs = append(protectedErrs,
+				fmt.Errorf("policy %s has terminationProtection enabled", policy.GetName()))
+
+			if opts.DryRun {
+				fmt.Printf("policy %s is termination protected; uninstall would be blocked\n", policy.GetName())
+
+				continue
+			}
+
+			if err := recordTerminationProtectedEvent(ctx, clientset, policy); err != nil {
+				return fmt.Errorf("failed to record a TerminationProtected event on policy %s: %w",
+					policy.GetName(), err)
+			}
+
+			if err := setTerminationProtectedCondition(ctx, policyClient, policy); err != nil {
+				return fmt.Errorf("failed to set the TerminationProtected condition on policy %s: %w",
+					policy.GetName(), err)
+			}
+
+			continue
+		}
+
+		policyCtx := ctx
+		policyCancel := func() {}
+
+		if opts.PolicyTimeout > 0 {
+			policyCtx, policyCancel = context.WithTimeout(ctx, opts.PolicyTimeout)
+		}
+
+		if waitForPrune {
+			if opts.DryRun {
+				refs, err := relatedObjectRefs(policy)
+				if err != nil {
+					policyCancel()
+
+					return err
+				}
+
+				fmt.Printf("policy %s would wait for %d related object(s) to be pruned\n", policy.GetName(), len(refs))
+
+				for _, ref := range refs {
+					fmt.Printf("  would prune %s %s %s/%s\n", ref.apiVersion, ref.kind, ref.namespace, ref.name)
+				}
+			} else if err := waitForRelatedObjectsPruned(policyCtx, dynamicClient, mapper, policy); err != nil {
+				policyCancel()
+
+				// Only attribute the failure to a deadline TriggerUninstall itself imposed (either
+				// opts.PolicyTimeout on this policy, or opts.OverallDeadline on the whole run). If
+				// neither fired, the wait simply hasn't converged yet (including when the caller's
+				// own ctx expired), so it's reported as prune-pending rather than a deadline. Once the
+				// caller's ctx is done every context derived from it is done too, so neither deadline
+				// counts as having fired then.
+				reason := UninstallFailPrunePending
+				if callerCtx.Err() == nil &&
+					((opts.PolicyTimeout > 0 && policyCtx.Err() != nil) ||
+						(overallDeadlineCtx != nil && overallDeadlineCtx.Err() != nil)) {
+					reason = UninstallFailContextDeadline
+				}
+
+				uErr := newUninstallError(reason, policyMeta(policy), err)
+				_ = recordFailureEvents(ctx, clientset, deploymentMeta, policyMeta(policy), uErr)
+
+				return uErr
+			}
+		}
+
+		policyCancel()
+
+		if opts.DryRun {
+			fmt.Printf("policy %s would have its %s finalizer removed\n", policy.GetName(), common.PruneObjectFinalizer)
+
+			continue
+		}
+
+		if err := removeFinalizerWithRetry(ctx, policyClient, policy, opts.Backoff); err != nil {
+			uErr := newUninstallError(UninstallFailFinalizerStuck, policyMeta(policy), err)
+			_ = recordFailureEvents(ctx, clientset, deploymentMeta, policyMeta(policy), uErr)
+
+			return uErr
+		}
+	}
+
+	if len(protectedErrs) != 0 {
+		if opts.DryRun {
+			return fmt.Errorf("uninstall would be blocked by termination-protected policies: %w",
+				utilerrors.NewAggregate(protectedErrs))
+		}
+
+		if err := recordTerminationProtectedEvent(ctx, clientset, deployment); err != nil {
+			return fmt.Errorf("failed to record a TerminationProtected event on the deployment: %w", err)
+		}
+
+		return fmt.Errorf("uninstall blocked by termination-protected policies: %w",
+			utilerrors.NewAggregate(protectedErrs))
+	}
+
+	if opts.DryRun {
+		fmt.Printf("deployment %s/%s would be annotated with %s=true\n",
+			deploymentNamespace, deploymentName, common.UninstallingAnnotation)
+
+		return nil
+	}
+
+	if err := setUninstallingAnnotationWithRetry(ctx, clientset, deployment, opts.Backoff); err != nil {
+		reason := Reason("")
+		if k8serrors.IsConflict(err) {
+			reason = UninstallFailAnnotationConflict
+		}
+
+		if reason == "" {
+			return fmt.Errorf("failed to set the uninstalling annotation on the deployment: %w", err)
+		}
+
+		return newUninstallError(reason, deploymentMeta, err)
+	}
+
+	return nil
+}
+
+// removeFinalizerWithRetry retries removeFinalizer on a resource version conflict, re-fetching the
+// policy between attempts so the retried update applies to the latest version.
+func removeFinalizerWithRetry(
+	ctx context.Context, policyClient dynamic.ResourceInterface, policy *unstructured.Unstructured,
+	backoff wait.Backoff,
+) error {
+	return retry.OnError(backoff, k8serrors.IsConflict, func() error {
+		err := removeFinalizer(ctx, policyClient, policy, common.PruneObjectFinalizer)
+		if k8serrors.IsConflict(err) {
+			latest, getErr := policyClient.Get(ctx, policy.GetName(), metav1.GetOptions{})
+			if getErr == nil {
+				*policy = *latest
+			}
+		}
+
+		return err
+	})
+}
+
+// setUninstallingAnnotationWithRetry retries setUninstallingAnnotation on a resource version
+// conflict, re-fetching the Deployment between attempts so the retried update applies to the latest
+// version.
+func setUninstallingAnnotationWithRetry(
+	ctx context.Context, clientset *kubernetes.Clientset, deployment *appsv1.Deployment, backoff wait.Backoff,
+) error {
+	return retry.OnError(backoff, k8serrors.IsConflict, func() error {
+		err := setUninstallingAnnotation(ctx, clientset, deployment)
+		if k8serrors.IsConflict(err) {
+			latest, getErr := clientset.AppsV1().Deployments(deployment.Namespace).Get(
+				ctx, deployment.Name, metav1.GetOptions{},
+			)
+			if getErr == nil {
+				*deployment = *latest
+			}
+		}
+
+		return err
+	})
+}
+
+// policyMeta builds the identifying information needed for an *Error or Event from a
+// ConfigurationPolicy.
+func policyMeta(policy *unstructured.Unstructured) metaObject {
+	gvk := policy.GroupVersionKind()
+
+	return metaObject{
+		apiVersion: gvk.GroupVersion().String(),
+		kind:       gvk.Kind,
+		namespace:  policy.GetNamespace(),
+		name:       policy.GetName(),
+	}
+}
+
+// isTerminationProtected reports whether the policy's spec.terminationProtection field is set to
+// true, which means its related objects must never be pruned and its finalizer must never be
+// removed as part of an uninstall. Only TriggerUninstall checks this; the controller's own
+// reconcile loop does not (see the package doc).
+//
+// This reads the field off the unstructured object rather than a typed ConfigurationPolicySpec
+// because that type isn't defined anywhere triggeruninstall can import from; the CRD's OpenAPI
+// schema must also declare spec.terminationProtection (it is dropped on admission otherwise), which
+// has to happen alongside the API type rather than in this package. Because nothing here guarantees
+// the field is actually a bool on admission, a present-but-malformed value is treated as protected
+// rather than silently coerced to false, so a decode failure fails closed instead of open.
+func isTerminationProtected(policy *unstructured.Unstructured) bool {
+	protected, found, err := unstructured.NestedBool(policy.Object, "spec", "terminationProtection")
+	if err != nil {
+		return true
+	}
+
+	return found && protected
+}
+
+// setTerminationProtectedCondition records on the policy's status that an uninstall attempt was
+// blocked because of spec.terminationProtection, so that users inspecting the policy understand why
+// its finalizer is still present.
+func setTerminationProtectedCondition(
+	ctx context.Context, policyClient dynamic.ResourceInterface, policy *unstructured.Unstructured,
+) error {
+	condition := map[string]interface{}{
+		"type":               common.TerminationProtectedConditionType,
+		"status":             "True",
+		"reason":             "TerminationProtectionEnabled",
+		"message":            "Uninstall cleanup was skipped because spec.terminationProtection is true",
+		"lastTransitionTime": metav1.Now().UTC().Format(time.RFC3339),
+	}
+
+	conditions, _, _ := unstructured.NestedSlice(policy.Object, "status", "conditions")
+	conditions = upsertConditionByType(conditions, condition)
+
+	if err := unstructured.SetNestedSlice(policy.Object, conditions, "status", "conditions"); err != nil {
+		return err
+	}
+
+	_, err := policyClient.UpdateStatus(ctx, policy, metav1.UpdateOptions{})
+
+	return err
+}
+
+// upsertConditionByType replaces the condition in conditions that shares condition's "type" field, or
+// appends condition if none match, mirroring the usual Kubernetes convention of keeping at most one
+// condition per type instead of letting repeated updates accumulate duplicate entries.
+func upsertConditionByType(conditions []interface{}, condition map[string]interface{}) []interface{} {
+	for i, existing := range conditions {
+		existingMap, ok := existing.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if existingMap["type"] == condition["type"] {
+			conditions[i] = condition
+
+			return conditions
+		}
+	}
+
+	return append(conditions, condition)
+}
+
+// recordTerminationProtectedEvent emits a Warning event on obj noting that an uninstall was blocked
+// by termination protection.
+func recordTerminationProtectedEvent(
+	ctx context.Context, clientset *kubernetes.Clientset, obj metav1.Object,
+) error {
+	ref := deploymentOrPolicyMeta(obj)
+
+	return recordEvent(ctx, clientset, ref, "TerminationProtected",
+		fmt.Sprintf("Uninstall cleanup skipped for %s/%s: terminationProtection is true", ref.namespace, ref.name))
+}
+
+// recordFailureEvents records uErr as a Warning event on both the Deployment and the
+// ConfigurationPolicy whose cleanup it blocked, so that a user inspecting either object can see why
+// the uninstall is stuck without having to read controller logs. The failure being recorded is
+// often that the caller's ctx expired, so the events are created under their own short timeout
+// rather than under that ctx.
+func recordFailureEvents(
+	_ context.Context, clientset *kubernetes.Clientset, deployment, policy metaObject, uErr *Error,
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return utilerrors.NewAggregate([]error{
+		recordEvent(ctx, clientset, deployment, string(uErr.Reason), uErr.Error()),
+		recordEvent(ctx, clientset, policy, string(uErr.Reason), uErr.Error()),
+	})
+}
+
+func recordEvent(
+	ctx context.Context, clientset *kubernetes.Clientset, ref metaObject, reason, message string,
+) error {
+	eventNamespace := ref.namespace
+	if eventNamespace == "" {
+		eventNamespace = "default"
+	}
+
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: "config-policy-controller-uninstall-",
+			Namespace:    eventNamespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: ref.apiVersion,
+			Kind:       ref.kind,
+			Namespace:  ref.namespace,
+			Name:       ref.name,
+		},
+		Reason:         reason,
+		Message:        message,
+		Type:           corev1.EventTypeWarning,
+		FirstTimestamp: metav1.Now(),
+		LastTimestamp:  metav1.Now(),
+	}
+
+	_, err := clientset.CoreV1().Events(eventNamespace).Create(ctx, event, metav1.CreateOptions{})
+
+	return err
+}
+
+// deploymentOrPolicyMeta builds a metaObject for either the Deployment or the unstructured
+// ConfigurationPolicy types that TriggerUninstall emits events for.
+func deploymentOrPolicyMeta(obj metav1.Object) metaObject {
+	switch v := obj.(type) {
+	case *appsv1.Deployment:
+		return metaObject{apiVersion: "apps/v1", kind: "Deployment", namespace: v.GetNamespace(), name: v.GetName()}
+	case *unstructured.Unstructured:
+		return policyMeta(v)
+	default:
+		return metaObject{namespace: obj.GetNamespace(), name: obj.GetName()}
+	}
+}
+
+// waitForRelatedObjectsPruned issues a delete for each of the policy's related objects that isn't
+// already being deleted, and then polls until every one of them returns NotFound or ctx is done.
+func waitForRelatedObjectsPruned(
+	ctx context.Context, dynamicClient dynamic.Interface, mapper meta.RESTMapper,
+	policy *unstructured.Unstructured,
+) error {
+	refs, err := relatedObjectRefs(policy)
+	if err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		client, err := resourceClientFor(dynamicClient, mapper, ref)
+		if err != nil {
+			return err
+		}
+
+		obj, err := client.Get(ctx, ref.name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if obj.GetDeletionTimestamp() == nil {
+			if err := client.Delete(ctx, ref.name, metav1.DeleteOptions{}); err != nil && !k8serrors.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+
+	return wait.PollUntilContextCancel(ctx, relatedObjectPollInterval, true, func(ctx context.Context) (bool, error) {
+		for _, ref := range refs {
+			client, err := resourceClientFor(dynamicClient, mapper, ref)
+			if err != nil {
+				return false, err
+			}
+
+			if _, err := client.Get(ctx, ref.name, metav1.GetOptions{}); err == nil {
+				return false, nil
+			} else if !k8serrors.IsNotFound(err) {
+				return false, err
+			}
+		}
+
+		return true, nil
+	})
+}
+
+type relatedObjectRef struct {
+	apiVersion string
+	kind       string
+	namespace  string
+	name       string
+}
+
+// relatedObjectRefs reads the policy's `status.relatedObjects` list, which records every object the
+// policy's pruneObjectBehavior is tracking.
+func relatedObjectRefs(policy *unstructured.Unstructured) ([]relatedObjectRef, error) {
+	related, found, err := unstructured.NestedSlice(policy.Object, "status", "relatedObjects")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read status.relatedObjects: %w", err)
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	refs := make([]relatedObjectRef, 0, len(related))
+
+	for _, item := range related {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		object, _, _ := unstructured.NestedMap(entry, "object")
+
+		apiVersion, _, _ := unstructured.NestedString(object, "apiVersion")
+		kind, _, _ := unstructured.NestedString(object, "kind")
+		metadata, _, _ := unstructured.NestedMap(object, "metadata")
+		name, _, _ := unstructured.NestedString(metadata, "name")
+		namespace, _, _ := unstructured.NestedString(metadata, "namespace")
+
+		if name == "" || kind == "" {
+			continue
+		}
+
+		refs = append(refs, relatedObjectRef{
+			apiVersion: apiVersion,
+			kind:       kind,
+			namespace:  namespace,
+			name:       name,
+		})
+	}
+
+	return refs, nil
+}
+
+func resourceClientFor(
+	dynamicClient dynamic.Interface, mapper meta.RESTMapper, ref relatedObjectRef,
+) (dynamic.ResourceInterface, error) {
+	gv, err := schema.ParseGroupVersion(ref.apiVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse apiVersion %s: %w", ref.apiVersion, err)
+	}
+
+	mapping, err := mapper.RESTMapping(gv.WithKind(ref.kind).GroupKind(), gv.Version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map kind %s to a resource: %w", ref.kind, err)
+	}
+
+	if ref.namespace == "" {
+		return dynamicClient.Resource(mapping.Resource), nil
+	}
+
+	return dynamicClient.Resource(mapping.Resource).Namespace(ref.namespace), nil
+}
+
+// newRESTMapper builds a one-shot snapshot REST mapper from the cluster's discovered API group
+// resources. TriggerUninstall is a short-lived CLI operation, so it doesn't need a mapper that
+// invalidates its cache as discovery changes.
+func newRESTMapper(clientset *kubernetes.Clientset) (meta.RESTMapper, error) {
+	groupResources, err := restmapper.GetAPIGroupResources(clientset.Discovery())
+	if err != nil {
+		return nil, err
+	}
+
+	return restmapper.NewDiscoveryRESTMapper(groupResources), nil
+}
+
+func hasFinalizer(obj *unstructured.Unstructured, finalizer string) bool {
+	for _, f := range obj.GetFinalizers() {
+		if f == finalizer {
+			return true
+		}
+	}
+
+	return false
+}
+
+func removeFinalizer(
+	ctx context.Context, client dynamic.ResourceInterface, obj *unstructured.Unstructured, finalizer string,
+) error {
+	finalizers := obj.GetFinalizers()
+	kept := make([]string, 0, len(finalizers))
+
+	for _, f := range finalizers {
+		if f != finalizer {
+			kept = append(kept, f)
+		}
+	}
+
+	obj.SetFinalizers(kept)
+
+	_, err := client.Update(ctx, obj, metav1.UpdateOptions{})
+
+	return err
+}
+
+func setUninstallingAnnotation(
+	ctx context.Context, clientset *kubernetes.Clientset, deployment *appsv1.Deployment,
+) error {
+	annotations := deployment.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	annotations[common.UninstallingAnnotation] = "true"
+	deployment.SetAnnotations(annotations)
+
+	_, err := clientset.AppsV1().Deployments(deployment.Namespace).Update(ctx, deployment, metav1.UpdateOptions{})
+
+	return err
+}
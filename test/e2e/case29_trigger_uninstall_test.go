@@ -4,19 +4,25 @@ package e2e
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
 
 	"open-cluster-management.io/config-policy-controller/pkg/common"
 	"open-cluster-management.io/config-policy-controller/pkg/triggeruninstall"
 	"open-cluster-management.io/config-policy-controller/test/utils"
 )
 
-// This test only works when the controller is running in the cluster.
+// This test only works when the controller is running in the cluster. It drives
+// triggeruninstall.TriggerUninstall directly, the same one-shot cleanup the trigger-uninstall CLI
+// subcommand runs before an uninstall; it does not exercise the controller's own reconcile loop, so
+// it says nothing about what happens to a ConfigurationPolicy deleted by any other means.
 var _ = Describe("Clean up during uninstalls", Label("running-in-cluster"), Ordered, func() {
 	const (
 		configMapName        string = "case29-trigger-uninstall"
@@ -65,7 +71,9 @@ var _ = Describe("Clean up during uninstalls", Label("running-in-cluster"), Orde
 		)
 		defer ctxCancel()
 
-		err = triggeruninstall.TriggerUninstall(ctx, config, deploymentName, deploymentNamespace, testNamespace)
+		err = triggeruninstall.TriggerUninstall(
+			ctx, config, deploymentName, deploymentNamespace, testNamespace, triggeruninstall.DefaultOptions(),
+		)
 		Expect(err).To(BeNil())
 
 		By("Verifying that the uninstall annotation was set on the Deployment")
@@ -120,6 +128,297 @@ var _ = Describe("Clean up during uninstalls", Label("running-in-cluster"), Orde
 	})
 })
 
+// This test only works when the controller is running in the cluster.
+var _ = Describe("Clean up during uninstalls with the wait annotation set", Label("running-in-cluster"), Ordered, func() {
+	const (
+		configMapName        string = "case29-slow-delete"
+		configMapFinalizer   string = "test.io/slow-delete"
+		deploymentName       string = "config-policy-controller"
+		deploymentNamespace  string = "open-cluster-management-agent-addon"
+		policyName           string = "case29-trigger-uninstall-wait"
+		policyYAMLPath       string = "../resources/case29_trigger_uninstall/policy_wait.yaml"
+		configMapYAMLPath    string = "../resources/case29_trigger_uninstall/configmap_slow_delete.yaml"
+		pruneObjectFinalizer string = "policy.open-cluster-management.io/delete-related-objects"
+		uninstallWaitAnno    string = "policy.open-cluster-management.io/uninstall-wait"
+	)
+
+	It("verifies that the finalizer is only cleared once the pruned ConfigMap is actually gone", func() {
+		By("Creating a configuration policy that prunes a ConfigMap with a slow-deleting finalizer")
+		utils.Kubectl("apply", "-f", configMapYAMLPath)
+		utils.Kubectl("apply", "-f", policyYAMLPath, "-n", testNamespace)
+
+		By("Verifying that the configuration policy is compliant and has the prune finalizer")
+		Eventually(func(g Gomega) {
+			policy := utils.GetWithTimeout(
+				clientManagedDynamic, gvrConfigPolicy, policyName, testNamespace, true, defaultTimeoutSeconds,
+			)
+			g.Expect(utils.GetComplianceState(policy)).To(Equal("Compliant"))
+
+			g.Expect(policy.GetFinalizers()).To(ContainElement(pruneObjectFinalizer))
+		}, defaultTimeoutSeconds, 1).Should(Succeed())
+
+		By("Setting the uninstall-wait annotation on the Deployment")
+		deployment, err := clientManaged.AppsV1().Deployments(deploymentNamespace).Get(
+			context.TODO(), deploymentName, metav1.GetOptions{},
+		)
+		Expect(err).To(BeNil())
+
+		annotations := deployment.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+
+		annotations[uninstallWaitAnno] = "true"
+		deployment.SetAnnotations(annotations)
+
+		_, err = clientManaged.AppsV1().Deployments(deploymentNamespace).Update(
+			context.TODO(), deployment, metav1.UpdateOptions{},
+		)
+		Expect(err).To(BeNil())
+
+		By("Triggering an uninstall in a goroutine since it should block on the ConfigMap")
+		config, err := LoadConfig("", kubeconfigManaged, "")
+		Expect(err).To(BeNil())
+
+		ctx, ctxCancel := context.WithDeadline(
+			context.Background(),
+			time.Now().Add(time.Duration(defaultTimeoutSeconds)*time.Second),
+		)
+		defer ctxCancel()
+
+		uninstallDone := make(chan error, 1)
+
+		go func() {
+			uninstallDone <- triggeruninstall.TriggerUninstall(
+				ctx, config, deploymentName, deploymentNamespace, testNamespace, triggeruninstall.DefaultOptions(),
+			)
+		}()
+
+		By("Verifying that the policy finalizer is not removed while the ConfigMap still has its own finalizer")
+		Consistently(func(g Gomega) {
+			policy := utils.GetWithTimeout(
+				clientManagedDynamic, gvrConfigPolicy, policyName, testNamespace, true, defaultTimeoutSeconds,
+			)
+			g.Expect(policy.GetFinalizers()).To(ContainElement(pruneObjectFinalizer))
+		}, "5s", "1s").Should(Succeed())
+
+		By("Removing the slow-deleting finalizer from the ConfigMap")
+		Eventually(func(g Gomega) {
+			cm, err := clientManaged.CoreV1().ConfigMaps("default").Get(
+				context.TODO(), configMapName, metav1.GetOptions{},
+			)
+			g.Expect(err).To(BeNil())
+
+			cm.SetFinalizers(nil)
+
+			_, err = clientManaged.CoreV1().ConfigMaps("default").Update(context.TODO(), cm, metav1.UpdateOptions{})
+			g.Expect(err).To(BeNil())
+		}, defaultTimeoutSeconds, 1).Should(Succeed())
+
+		By("Verifying that TriggerUninstall now completes and the policy finalizer is cleared")
+		Eventually(uninstallDone, defaultTimeoutSeconds).Should(Receive(BeNil()))
+
+		policy := utils.GetWithTimeout(
+			clientManagedDynamic, gvrConfigPolicy, policyName, testNamespace, true, defaultTimeoutSeconds,
+		)
+		Expect(policy.GetFinalizers()).To(HaveLen(0))
+	})
+
+	It("surfaces a PrunePending reason on the policy's events when the prune never finishes", func() {
+		By("Creating a configuration policy that prunes a ConfigMap with a finalizer that is never removed")
+		utils.Kubectl("apply", "-f", configMapYAMLPath)
+		utils.Kubectl("apply", "-f", policyYAMLPath, "-n", testNamespace)
+
+		Eventually(func(g Gomega) {
+			policy := utils.GetWithTimeout(
+				clientManagedDynamic, gvrConfigPolicy, policyName, testNamespace, true, defaultTimeoutSeconds,
+			)
+			g.Expect(utils.GetComplianceState(policy)).To(Equal("Compliant"))
+			g.Expect(policy.GetFinalizers()).To(ContainElement(pruneObjectFinalizer))
+		}, defaultTimeoutSeconds, 1).Should(Succeed())
+
+		By("Setting the uninstall-wait annotation on the Deployment")
+		deployment, err := clientManaged.AppsV1().Deployments(deploymentNamespace).Get(
+			context.TODO(), deploymentName, metav1.GetOptions{},
+		)
+		Expect(err).To(BeNil())
+
+		annotations := deployment.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+
+		annotations[uninstallWaitAnno] = "true"
+		deployment.SetAnnotations(annotations)
+
+		_, err = clientManaged.AppsV1().Deployments(deploymentNamespace).Update(
+			context.TODO(), deployment, metav1.UpdateOptions{},
+		)
+		Expect(err).To(BeNil())
+
+		By("Triggering an uninstall with a short deadline that the ConfigMap can't be pruned within")
+		config, err := LoadConfig("", kubeconfigManaged, "")
+		Expect(err).To(BeNil())
+
+		ctx, ctxCancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer ctxCancel()
+
+		err = triggeruninstall.TriggerUninstall(
+			ctx, config, deploymentName, deploymentNamespace, testNamespace, triggeruninstall.DefaultOptions(),
+		)
+		Expect(err).ToNot(BeNil())
+
+		var uErr *triggeruninstall.Error
+		Expect(errors.As(err, &uErr)).To(BeTrue())
+		Expect(uErr.Reason).To(Equal(triggeruninstall.UninstallFailPrunePending))
+
+		By("Verifying that the policy has a PrunePending event")
+		Eventually(func(g Gomega) {
+			events, err := clientManaged.CoreV1().Events(testNamespace).List(context.TODO(), metav1.ListOptions{
+				FieldSelector: "involvedObject.name=" + policyName,
+			})
+			g.Expect(err).To(BeNil())
+
+			reasons := make([]string, 0, len(events.Items))
+			for _, event := range events.Items {
+				reasons = append(reasons, event.Reason)
+			}
+
+			g.Expect(reasons).To(ContainElement(string(triggeruninstall.UninstallFailPrunePending)))
+		}, defaultTimeoutSeconds, 1).Should(Succeed())
+	})
+
+	AfterAll(func() {
+		deleteConfigPolicies([]string{policyName})
+
+		err := clientManaged.CoreV1().ConfigMaps("default").Delete(
+			context.TODO(), configMapName, metav1.DeleteOptions{},
+		)
+		if !k8serrors.IsNotFound(err) {
+			Expect(err).To(BeNil())
+		}
+
+		Eventually(func(g Gomega) {
+			deployment, err := clientManaged.AppsV1().Deployments(deploymentNamespace).Get(
+				context.TODO(), deploymentName, metav1.GetOptions{},
+			)
+			g.Expect(err).To(BeNil())
+
+			annotations := deployment.GetAnnotations()
+			delete(annotations, uninstallWaitAnno)
+			delete(annotations, common.UninstallingAnnotation)
+			deployment.SetAnnotations(annotations)
+
+			_, err = clientManaged.AppsV1().Deployments(deploymentNamespace).Update(
+				context.TODO(), deployment, metav1.UpdateOptions{},
+			)
+			g.Expect(err).To(BeNil())
+		}, defaultTimeoutSeconds, 1).Should(Succeed())
+	})
+})
+
+// This test only works when the controller is running in the cluster.
+var _ = Describe("Termination protection during uninstalls", Label("running-in-cluster"), Ordered, func() {
+	const (
+		deploymentName        string = "config-policy-controller"
+		deploymentNamespace   string = "open-cluster-management-agent-addon"
+		protectedPolicyName   string = "case29-trigger-uninstall-protected"
+		unprotectedPolicyName string = "case29-trigger-uninstall-unprotected"
+		protectedYAMLPath     string = "../resources/case29_trigger_uninstall/policy_protected.yaml"
+		unprotectedYAMLPath   string = "../resources/case29_trigger_uninstall/policy_unprotected.yaml"
+		pruneObjectFinalizer  string = "policy.open-cluster-management.io/delete-related-objects"
+		terminationCondition  string = "TerminationProtected"
+	)
+
+	It("only removes the finalizer from the policy without terminationProtection", func() {
+		By("Creating a protected and an unprotected configuration policy")
+		utils.Kubectl("apply", "-f", protectedYAMLPath, "-n", testNamespace)
+		utils.Kubectl("apply", "-f", unprotectedYAMLPath, "-n", testNamespace)
+
+		Eventually(func(g Gomega) {
+			policy := utils.GetWithTimeout(
+				clientManagedDynamic, gvrConfigPolicy, protectedPolicyName, testNamespace, true, defaultTimeoutSeconds,
+			)
+			g.Expect(utils.GetComplianceState(policy)).To(Equal("Compliant"))
+			g.Expect(policy.GetFinalizers()).To(ContainElement(pruneObjectFinalizer))
+		}, defaultTimeoutSeconds, 1).Should(Succeed())
+
+		Eventually(func(g Gomega) {
+			policy := utils.GetWithTimeout(
+				clientManagedDynamic, gvrConfigPolicy, unprotectedPolicyName, testNamespace, true,
+				defaultTimeoutSeconds,
+			)
+			g.Expect(utils.GetComplianceState(policy)).To(Equal("Compliant"))
+			g.Expect(policy.GetFinalizers()).To(ContainElement(pruneObjectFinalizer))
+		}, defaultTimeoutSeconds, 1).Should(Succeed())
+
+		By("Triggering an uninstall")
+		config, err := LoadConfig("", kubeconfigManaged, "")
+		Expect(err).To(BeNil())
+
+		ctx, ctxCancel := context.WithDeadline(
+			context.Background(),
+			time.Now().Add(time.Duration(defaultTimeoutSeconds)*time.Second),
+		)
+		defer ctxCancel()
+
+		err = triggeruninstall.TriggerUninstall(
+			ctx, config, deploymentName, deploymentNamespace, testNamespace, triggeruninstall.DefaultOptions(),
+		)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(protectedPolicyName))
+
+		By("Verifying that the protected policy retains its finalizer and managed ConfigMap")
+		protectedPolicy := utils.GetWithTimeout(
+			clientManagedDynamic, gvrConfigPolicy, protectedPolicyName, testNamespace, true, defaultTimeoutSeconds,
+		)
+		Expect(protectedPolicy.GetFinalizers()).To(ContainElement(pruneObjectFinalizer))
+
+		conditions, _, _ := unstructured.NestedSlice(protectedPolicy.Object, "status", "conditions")
+		conditionTypes := make([]string, 0, len(conditions))
+
+		for _, c := range conditions {
+			condition, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			conditionTypes = append(conditionTypes, condition["type"].(string))
+		}
+
+		Expect(conditionTypes).To(ContainElement(terminationCondition))
+
+		_, err = clientManaged.CoreV1().ConfigMaps("default").Get(
+			context.TODO(), protectedPolicyName, metav1.GetOptions{},
+		)
+		Expect(err).To(BeNil())
+
+		By("Verifying that the unprotected policy has lost its finalizer")
+		unprotectedPolicy := utils.GetWithTimeout(
+			clientManagedDynamic, gvrConfigPolicy, unprotectedPolicyName, testNamespace, true, defaultTimeoutSeconds,
+		)
+		Expect(unprotectedPolicy.GetFinalizers()).To(HaveLen(0))
+
+		By("Verifying that the Deployment was not annotated as uninstalling")
+		deployment, err := clientManaged.AppsV1().Deployments(deploymentNamespace).Get(
+			context.TODO(), deploymentName, metav1.GetOptions{},
+		)
+		Expect(err).To(BeNil())
+		Expect(deployment.GetAnnotations()).ToNot(HaveKey(common.UninstallingAnnotation))
+	})
+
+	AfterAll(func() {
+		deleteConfigPolicies([]string{protectedPolicyName, unprotectedPolicyName})
+
+		for _, name := range []string{protectedPolicyName, unprotectedPolicyName} {
+			err := clientManaged.CoreV1().ConfigMaps("default").Delete(context.TODO(), name, metav1.DeleteOptions{})
+			if !k8serrors.IsNotFound(err) {
+				Expect(err).To(BeNil())
+			}
+		}
+	})
+})
+
 // This test only works when the controller is running in the cluster.
 var _ = Describe("Clean up the finalizer on the Deployment", Label("running-in-cluster"), Ordered, func() {
 	const (
@@ -175,3 +474,113 @@ var _ = Describe("Clean up the finalizer on the Deployment", Label("running-in-c
 		}, defaultTimeoutSeconds, 1).Should(Succeed())
 	})
 })
+
+// This test only works when the controller is running in the cluster.
+var _ = Describe("TriggerUninstall Options", Label("running-in-cluster"), Ordered, func() {
+	const (
+		deploymentName       string = "config-policy-controller"
+		deploymentNamespace  string = "open-cluster-management-agent-addon"
+		policy1Name          string = "case29-dry-run-1"
+		policy2Name          string = "case29-dry-run-2"
+		policy1YAMLPath      string = "../resources/case29_trigger_uninstall/policy_dry_run_1.yaml"
+		policy2YAMLPath      string = "../resources/case29_trigger_uninstall/policy_dry_run_2.yaml"
+		pruneObjectFinalizer string = "policy.open-cluster-management.io/delete-related-objects"
+	)
+
+	BeforeAll(func() {
+		utils.Kubectl("apply", "-f", policy1YAMLPath, "-n", testNamespace)
+		utils.Kubectl("apply", "-f", policy2YAMLPath, "-n", testNamespace)
+
+		Eventually(func(g Gomega) {
+			for _, name := range []string{policy1Name, policy2Name} {
+				policy := utils.GetWithTimeout(
+					clientManagedDynamic, gvrConfigPolicy, name, testNamespace, true, defaultTimeoutSeconds,
+				)
+				g.Expect(utils.GetComplianceState(policy)).To(Equal("Compliant"))
+				g.Expect(policy.GetFinalizers()).To(ContainElement(pruneObjectFinalizer))
+			}
+		}, defaultTimeoutSeconds, 1).Should(Succeed())
+	})
+
+	AfterAll(func() {
+		deleteConfigPolicies([]string{policy1Name, policy2Name})
+
+		for _, name := range []string{policy1Name, policy2Name} {
+			err := clientManaged.CoreV1().ConfigMaps("default").Delete(context.TODO(), name, metav1.DeleteOptions{})
+			if !k8serrors.IsNotFound(err) {
+				Expect(err).To(BeNil())
+			}
+		}
+	})
+
+	It("does not remove any finalizers or set the uninstalling annotation in dry-run mode", func() {
+		config, err := LoadConfig("", kubeconfigManaged, "")
+		Expect(err).To(BeNil())
+
+		ctx, ctxCancel := context.WithDeadline(
+			context.Background(), time.Now().Add(time.Duration(defaultTimeoutSeconds)*time.Second),
+		)
+		defer ctxCancel()
+
+		opts := triggeruninstall.DefaultOptions()
+		opts.DryRun = true
+
+		err = triggeruninstall.TriggerUninstall(ctx, config, deploymentName, deploymentNamespace, testNamespace, opts)
+		Expect(err).To(BeNil())
+
+		for _, name := range []string{policy1Name, policy2Name} {
+			policy := utils.GetWithTimeout(
+				clientManagedDynamic, gvrConfigPolicy, name, testNamespace, true, defaultTimeoutSeconds,
+			)
+			Expect(policy.GetFinalizers()).To(ContainElement(pruneObjectFinalizer))
+		}
+
+		deployment, err := clientManaged.AppsV1().Deployments(deploymentNamespace).Get(
+			context.TODO(), deploymentName, metav1.GetOptions{},
+		)
+		Expect(err).To(BeNil())
+		Expect(deployment.GetAnnotations()).ToNot(HaveKey(common.UninstallingAnnotation))
+	})
+
+	It("leaves a skipped policy's finalizer in place while clearing the other policy's", func() {
+		config, err := LoadConfig("", kubeconfigManaged, "")
+		Expect(err).To(BeNil())
+
+		ctx, ctxCancel := context.WithDeadline(
+			context.Background(), time.Now().Add(time.Duration(defaultTimeoutSeconds)*time.Second),
+		)
+		defer ctxCancel()
+
+		opts := triggeruninstall.DefaultOptions()
+		opts.SkipPolicies = []types.NamespacedName{{Namespace: testNamespace, Name: policy1Name}}
+
+		err = triggeruninstall.TriggerUninstall(ctx, config, deploymentName, deploymentNamespace, testNamespace, opts)
+		Expect(err).To(BeNil())
+
+		skippedPolicy := utils.GetWithTimeout(
+			clientManagedDynamic, gvrConfigPolicy, policy1Name, testNamespace, true, defaultTimeoutSeconds,
+		)
+		Expect(skippedPolicy.GetFinalizers()).To(ContainElement(pruneObjectFinalizer))
+
+		clearedPolicy := utils.GetWithTimeout(
+			clientManagedDynamic, gvrConfigPolicy, policy2Name, testNamespace, true, defaultTimeoutSeconds,
+		)
+		Expect(clearedPolicy.GetFinalizers()).To(HaveLen(0))
+
+		Eventually(func(g Gomega) {
+			deployment, err := clientManaged.AppsV1().Deployments(deploymentNamespace).Get(
+				context.TODO(), deploymentName, metav1.GetOptions{},
+			)
+			g.Expect(err).To(BeNil())
+
+			annotations := deployment.GetAnnotations()
+			delete(annotations, common.UninstallingAnnotation)
+			deployment.SetAnnotations(annotations)
+
+			_, err = clientManaged.AppsV1().Deployments(deploymentNamespace).Update(
+				context.TODO(), deployment, metav1.UpdateOptions{},
+			)
+			g.Expect(err).To(BeNil())
+		}, defaultTimeoutSeconds, 1).Should(Succeed())
+	})
+})